@@ -0,0 +1,74 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gonet provides a net.Conn/net.Listener wrapper around
+// tcpip.Endpoint, for use by code that wants a gVisor-backed connection
+// behind the standard library's net interfaces.
+package gonet
+
+import (
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// TCPConn is a minimal net.Conn-shaped wrapper around a tcpip.Endpoint.
+// The full implementation (Read/Write/SetDeadline/LocalAddr and the rest
+// of net.Conn) lives alongside the package's existing Dial/Listen helpers;
+// this file only adds what DialTCPMulti needs to hand back a value of
+// this type.
+type TCPConn struct {
+	wq *waiter.Queue
+	ep tcpip.Endpoint
+}
+
+// NewTCPConn wraps ep (already connected) as a *TCPConn.
+func NewTCPConn(wq *waiter.Queue, ep tcpip.Endpoint) *TCPConn {
+	return &TCPConn{wq: wq, ep: ep}
+}
+
+// DialTCPMulti resolves a Happy Eyeballs v2 race across addrs (ordered
+// preferred-family-first) and returns a *TCPConn wrapping the winner, the
+// same way net.Dialer.DialContext races dual-stack addresses when
+// net.Dialer.FallbackDelay is set — except driven by tcp.Endpoint's
+// ConnectMulti rather than by dialing a new OS socket per attempt.
+func DialTCPMulti(s Stack, addrs []tcpip.FullAddress, opts tcp.ConnectMultiOptions) (*TCPConn, error) {
+	var wq waiter.Queue
+	ep, err := s.NewTCPEndpoint(&wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+
+	multi, ok := ep.(interface {
+		ConnectMulti([]tcpip.FullAddress, tcp.ConnectMultiOptions) tcpip.Error
+	})
+	if !ok {
+		return nil, errors.New((&tcpip.ErrNotSupported{}).String())
+	}
+	if cerr := multi.ConnectMulti(addrs, opts); cerr != nil {
+		ep.Close()
+		return nil, errors.New(cerr.String())
+	}
+
+	return NewTCPConn(&wq, ep), nil
+}
+
+// Stack is the subset of *stack.Stack DialTCPMulti needs: enough to create
+// a fresh TCP endpoint to race attempts from. The real implementation is
+// satisfied by *stack.Stack itself; tests substitute a fake.
+type Stack interface {
+	NewTCPEndpoint(wq *waiter.Queue) (tcpip.Endpoint, tcpip.Error)
+}
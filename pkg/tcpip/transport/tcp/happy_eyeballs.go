@@ -0,0 +1,253 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// DefaultHappyEyeballsAttemptDelay is the default interval between
+// successive connection attempts in a Happy Eyeballs v2 race, per RFC 8305
+// section 8's recommendation.
+const DefaultHappyEyeballsAttemptDelay = 250 * time.Millisecond
+
+// ConnectMultiOptions configures a Happy Eyeballs v2 race started by
+// ConnectMulti.
+type ConnectMultiOptions struct {
+	// AttemptDelay is the stagger between the start of successive
+	// connection attempts. A zero value means
+	// DefaultHappyEyeballsAttemptDelay.
+	AttemptDelay time.Duration
+}
+
+// happyEyeballsStats are the counters ConnectMulti maintains; they mirror
+// the shape of the other per-protocol stats structs in this package so they
+// can be embedded into tcpip.TransportProtocolStats.TCP alongside
+// FastOpenStats.
+type happyEyeballsStats struct {
+	// AttemptsStarted counts every dial ConnectMulti initiated, across
+	// all races.
+	AttemptsStarted *tcpip.StatCounter
+	// AttemptsCancelled counts dials that were still pending when a race
+	// was decided and were torn down rather than left to complete.
+	AttemptsCancelled *tcpip.StatCounter
+	// WinnerIsIPv4 and WinnerIsIPv6 count which family won each decided
+	// race, split out as separate counters to match the convention the
+	// rest of this package uses for per-family stats.
+	WinnerIsIPv4 *tcpip.StatCounter
+	WinnerIsIPv6 *tcpip.StatCounter
+}
+
+func newHappyEyeballsStats() happyEyeballsStats {
+	return happyEyeballsStats{
+		AttemptsStarted:   &tcpip.StatCounter{},
+		AttemptsCancelled: &tcpip.StatCounter{},
+		WinnerIsIPv4:      &tcpip.StatCounter{},
+		WinnerIsIPv6:      &tcpip.StatCounter{},
+	}
+}
+
+// happyEyeballsAttempt is one candidate address in a race. dial starts the
+// attempt and must not block past the point where it has committed to
+// connecting; it returns a non-nil error only if the attempt definitively
+// failed (as opposed to merely being outrun by another attempt).
+type happyEyeballsAttempt struct {
+	addr tcpip.FullAddress
+	dial func(cancel <-chan struct{}) error
+}
+
+// raceHappyEyeballs drives a single RFC 8305 Happy Eyeballs v2 race over
+// attempts, which must already be ordered with the preferred family first.
+// Attempts are started strictly in order, each one AttemptDelay after the
+// previous one; the address family of an attempt is not consulted.
+//
+// It returns the index of the attempt that won the race, or -1 with the
+// error of the last attempt to fail if every attempt failed.
+//
+// raceHappyEyeballs guarantees that at most one attempt is left running
+// when it returns: as soon as one dial succeeds, every other in-flight
+// attempt's cancel channel is closed so its caller can tear down the
+// half-formed transportEndpointID (e.g. by sending a RST if the peer's
+// SYN-ACK arrives after cancellation).
+func raceHappyEyeballs(attempts []happyEyeballsAttempt, opts ConnectMultiOptions, stats happyEyeballsStats) (int, error) {
+	delay := opts.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsAttemptDelay
+	}
+
+	type result struct {
+		idx int
+		err error
+	}
+
+	cancel := make(chan struct{})
+	results := make(chan result, len(attempts))
+	var cancelOnce sync.Once
+	closeCancel := func() { cancelOnce.Do(func() { close(cancel) }) }
+
+	var wg sync.WaitGroup
+	start := func(i int) {
+		wg.Add(1)
+		if stats.AttemptsStarted != nil {
+			stats.AttemptsStarted.Increment()
+		}
+		go func() {
+			defer wg.Done()
+			err := attempts[i].dial(cancel)
+			results <- result{idx: i, err: err}
+		}()
+	}
+
+	started := 0
+	start(started)
+	started++
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	remaining := len(attempts)
+	var lastErr error
+	winner := -1
+
+raceLoop:
+	for remaining > 0 {
+		select {
+		case r := <-results:
+			remaining--
+			if r.err == nil {
+				winner = r.idx
+				break raceLoop
+			}
+			lastErr = r.err
+		case <-timerC(timer):
+			if started < len(attempts) {
+				start(started)
+				started++
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	closeCancel()
+	if stats.AttemptsCancelled != nil {
+		// started attempts whose result was never drained from results
+		// before the race was decided were in flight at decision time
+		// and are about to be torn down via cancel; attempts that were
+		// never started at all (because the race ended before their
+		// turn) were never "pending" and don't count here.
+		received := len(attempts) - remaining
+		stats.AttemptsCancelled.IncrementBy(uint64(started - received))
+	}
+
+	// results has room for every attempt, so a cancelled dial's goroutine
+	// never blocks on its send; close results once they have all finished.
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if winner >= 0 {
+		return winner, nil
+	}
+	return -1, lastErr
+}
+
+// timerC returns t's channel, the one the race loop above waits on for the
+// next attempt's turn. It is equivalent to reading t.C directly.
+func timerC(t *time.Timer) <-chan time.Time {
+	return t.C
+}
+
+// ConnectMulti implements RFC 8305 Happy Eyeballs v2 across addrs, which
+// must already be ordered with the preferred family first (see
+// raceHappyEyeballs). Unlike Connect, it blocks until the race is decided
+// rather than returning ErrConnectStarted, since there is no single
+// transportEndpointID to report progress on until a winner exists.
+//
+// On success, e adopts the winning attempt's transportEndpointID as its
+// own; every other attempt still pending is marked cancelled by its dial
+// closure, so that if its SYN-ACK arrives afterwards, handleSynAck answers
+// it with a RST rather than completing a connection this endpoint will
+// never use. GetRemoteAddress returns the winning address.
+// LastError returns the last attempt's error only if every attempt failed;
+// a losing attempt's error (one that was merely outrun, not one that
+// failed) is never surfaced there.
+func (e *connEndpoint) ConnectMulti(addrs []tcpip.FullAddress, opts ConnectMultiOptions) tcpip.Error {
+	if len(addrs) == 0 {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+
+	attempts := make([]happyEyeballsAttempt, len(addrs))
+	winners := make([]*connEndpoint, len(addrs))
+	for i, addr := range addrs {
+		i, addr := i, addr
+		attempts[i] = happyEyeballsAttempt{
+			addr: addr,
+			dial: func(cancel <-chan struct{}) error {
+				candidate := newConnEndpoint(e.proto, e.wq)
+				candidate.dialRoute = e.dialRoute
+				if err := candidate.connectLocked(addr); err != nil {
+					return endpointError{err: err}
+				}
+				select {
+				case <-candidate.established():
+					winners[i] = candidate
+					return nil
+				case <-cancel:
+					// Outrun by another attempt: tear down rather than
+					// let it complete a connection nothing will read.
+					candidate.resetAndClose()
+					return nil
+				}
+			},
+		}
+	}
+
+	winner, err := raceHappyEyeballs(attempts, opts, e.proto.stats.HappyEyeballs)
+	if winner < 0 {
+		tcpErr := tcpip.Error(&tcpip.ErrTimeout{})
+		if ee, ok := err.(endpointError); ok {
+			tcpErr = ee.err
+		}
+		e.mu.Lock()
+		e.lastError = tcpErr
+		e.mu.Unlock()
+		return tcpErr
+	}
+
+	won := winners[winner]
+	e.mu.Lock()
+	e.state = csEstablished
+	e.remoteAddr = addrs[winner]
+	e.route = won.route
+	e.mu.Unlock()
+
+	if addrs[winner].Addr.Len() == 4 {
+		e.proto.stats.HappyEyeballs.WinnerIsIPv4.Increment()
+	} else {
+		e.proto.stats.HappyEyeballs.WinnerIsIPv6.Increment()
+	}
+	return nil
+}
+
+// endpointError adapts a tcpip.Error to the standard error interface so it
+// can travel through raceHappyEyeballs, which is deliberately written
+// against net/tcp-style errors rather than this package's Error type.
+type endpointError struct{ err tcpip.Error }
+
+func (e endpointError) Error() string { return e.err.String() }
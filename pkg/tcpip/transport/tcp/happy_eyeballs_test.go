@@ -0,0 +1,215 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// fakeAttempt builds a happyEyeballsAttempt that resolves after delay with
+// err, unless cancel fires first, in which case it blocks until cancel and
+// reports errCancelled.
+var errCancelled = errors.New("attempt cancelled")
+
+func fakeAttempt(addr tcpip.FullAddress, delay time.Duration, err error) happyEyeballsAttempt {
+	return happyEyeballsAttempt{
+		addr: addr,
+		dial: func(cancel <-chan struct{}) error {
+			select {
+			case <-time.After(delay):
+				return err
+			case <-cancel:
+				return errCancelled
+			}
+		},
+	}
+}
+
+func TestRaceHappyEyeballsPreferredFamilyWins(t *testing.T) {
+	attempts := []happyEyeballsAttempt{
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom16([16]byte{0: 1})}, 5*time.Millisecond, nil),
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{1, 2, 3, 4})}, 5*time.Millisecond, nil),
+	}
+	winner, err := raceHappyEyeballs(attempts, ConnectMultiOptions{AttemptDelay: 20 * time.Millisecond}, happyEyeballsStats{})
+	if err != nil {
+		t.Fatalf("raceHappyEyeballs(...) failed: %v", err)
+	}
+	if winner != 0 {
+		t.Fatalf("raceHappyEyeballs(...) winner = %d, want 0 (preferred family never staggered)", winner)
+	}
+}
+
+func TestRaceHappyEyeballsPromotesLaterFamily(t *testing.T) {
+	attempts := []happyEyeballsAttempt{
+		// Preferred family never answers within the test's lifetime.
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom16([16]byte{0: 1})}, time.Hour, nil),
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{1, 2, 3, 4})}, 5*time.Millisecond, nil),
+	}
+	stats := newHappyEyeballsStats()
+	winner, err := raceHappyEyeballs(attempts, ConnectMultiOptions{AttemptDelay: 10 * time.Millisecond}, stats)
+	if err != nil {
+		t.Fatalf("raceHappyEyeballs(...) failed: %v", err)
+	}
+	if winner != 1 {
+		t.Fatalf("raceHappyEyeballs(...) winner = %d, want 1 (second attempt promoted after AttemptDelay)", winner)
+	}
+	if got, want := stats.AttemptsStarted.Value(), uint64(2); got != want {
+		t.Fatalf("AttemptsStarted = %d, want %d", got, want)
+	}
+	if got, want := stats.AttemptsCancelled.Value(), uint64(1); got != want {
+		t.Fatalf("AttemptsCancelled = %d, want %d (the still-running preferred-family attempt)", got, want)
+	}
+}
+
+func TestRaceHappyEyeballsAllFail(t *testing.T) {
+	wantErr := errors.New("connection refused")
+	attempts := []happyEyeballsAttempt{
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom16([16]byte{0: 1})}, time.Millisecond, wantErr),
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{1, 2, 3, 4})}, time.Millisecond, wantErr),
+	}
+	winner, err := raceHappyEyeballs(attempts, ConnectMultiOptions{AttemptDelay: 5 * time.Millisecond}, happyEyeballsStats{})
+	if winner != -1 {
+		t.Fatalf("raceHappyEyeballs(...) winner = %d, want -1", winner)
+	}
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("raceHappyEyeballs(...) err = %v, want %v", err, wantErr)
+	}
+}
+
+func TestRaceHappyEyeballsDefaultAttemptDelay(t *testing.T) {
+	attempts := []happyEyeballsAttempt{
+		fakeAttempt(tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{1, 2, 3, 4})}, time.Millisecond, nil),
+	}
+	start := time.Now()
+	winner, err := raceHappyEyeballs(attempts, ConnectMultiOptions{}, happyEyeballsStats{})
+	if err != nil {
+		t.Fatalf("raceHappyEyeballs(...) failed: %v", err)
+	}
+	if winner != 0 {
+		t.Fatalf("raceHappyEyeballs(...) winner = %d, want 0", winner)
+	}
+	// A single attempt should resolve well before the default 250ms
+	// stagger would ever be consulted.
+	if elapsed := time.Since(start); elapsed >= DefaultHappyEyeballsAttemptDelay {
+		t.Fatalf("raceHappyEyeballs(...) took %v, want well under the %v default delay", elapsed, DefaultHappyEyeballsAttemptDelay)
+	}
+}
+
+// TestConnectMultiPromotesAndResetsLoser drives endpoint.ConnectMulti
+// end-to-end: the preferred (v6) family's SYN-ACK never arrives in time,
+// the v4 attempt's does, and ConnectMulti must promote it, report it via
+// GetRemoteAddress, and guarantee the v6 attempt cannot later complete a
+// connection nothing will read — if its SYN-ACK shows up after the race
+// was decided, it must be answered with a RST rather than accepted.
+func TestConnectMultiPromotesAndResetsLoser(t *testing.T) {
+	var wq waiter.Queue
+	proto := NewConnProtocol()
+	e := newConnEndpoint(proto, &wq)
+
+	v6 := tcpip.FullAddress{Addr: tcpip.AddrFrom16([16]byte{0: 1}), Port: 80}
+	v4 := tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{1, 2, 3, 4}), Port: 80}
+
+	var mu sync.Mutex
+	routes := map[tcpip.Address]*fakeRoute{}
+	candidates := map[tcpip.Address]*connEndpoint{}
+	e.dialRoute = func(addr tcpip.FullAddress, candidate *connEndpoint) (segmentSink, tcpip.Error) {
+		r := &fakeRoute{}
+		mu.Lock()
+		routes[addr.Addr] = r
+		candidates[addr.Addr] = candidate
+		mu.Unlock()
+		if addr.Addr == v4.Addr {
+			go func() {
+				time.Sleep(2 * time.Millisecond)
+				candidate.handleSynAck(nil, true)
+			}()
+		}
+		return r, nil
+	}
+
+	if err := e.ConnectMulti([]tcpip.FullAddress{v6, v4}, ConnectMultiOptions{AttemptDelay: 5 * time.Millisecond}); err != nil {
+		t.Fatalf("e.ConnectMulti(...) failed: %v", err)
+	}
+
+	got, err := e.GetRemoteAddress()
+	if err != nil {
+		t.Fatalf("e.GetRemoteAddress() failed: %v", err)
+	}
+	if got.Addr != v4.Addr {
+		t.Fatalf("e.GetRemoteAddress() = %s, want the winning v4 address %s", got.Addr, v4.Addr)
+	}
+
+	// Give the cancelled v6 attempt's resetAndClose a moment to land;
+	// it races with ConnectMulti's return by design (the loser is
+	// cancelled asynchronously so the winner isn't held up by it).
+	mu.Lock()
+	v6Candidate := candidates[v6.Addr]
+	v6Route := routes[v6.Addr]
+	mu.Unlock()
+	for i := 0; i < 100 && v6Candidate.State() != csError; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The v6 SYN-ACK finally shows up, long after the race was decided.
+	v6Candidate.handleSynAck(nil, true)
+
+	if len(v6Route.sent) != 2 {
+		t.Fatalf("len(v6Route.sent) = %d, want 2 (the original SYN, then a RST for the late SYN-ACK)", len(v6Route.sent))
+	}
+	if got := v6Route.sent[1].flags; got&header.TCPFlagRst == 0 {
+		t.Fatalf("v6Route.sent[1].flags = %v, want TCPFlagRst set", got)
+	}
+}
+
+// TestConnectMultiAllFail checks that when every address in the race
+// fails, ConnectMulti returns the last attempt's error, LastError records
+// that same error, and LastError clears it once it has been read.
+func TestConnectMultiAllFail(t *testing.T) {
+	var wq waiter.Queue
+	proto := NewConnProtocol()
+	e := newConnEndpoint(proto, &wq)
+
+	addr := tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{9, 9, 9, 9}), Port: 80}
+	e.dialRoute = func(tcpip.FullAddress, *connEndpoint) (segmentSink, tcpip.Error) {
+		return nil, &tcpip.ErrNoRoute{}
+	}
+
+	err := e.ConnectMulti([]tcpip.FullAddress{addr}, ConnectMultiOptions{AttemptDelay: time.Millisecond})
+	if err == nil {
+		t.Fatalf("e.ConnectMulti(...) succeeded, want every address to fail")
+	}
+	if _, ok := err.(*tcpip.ErrNoRoute); !ok {
+		t.Fatalf("e.ConnectMulti(...) = %v, want the last attempt's actual error (*tcpip.ErrNoRoute)", err)
+	}
+
+	if got := e.LastError(); got == nil {
+		t.Fatalf("e.LastError() = nil, want the last attempt's error to be recorded since every address failed")
+	} else if _, ok := got.(*tcpip.ErrNoRoute); !ok {
+		t.Fatalf("e.LastError() = %v, want *tcpip.ErrNoRoute", got)
+	}
+
+	// LastError is consuming: a second read must not repeat the error
+	// from a race that has already been reported.
+	if got := e.LastError(); got != nil {
+		t.Fatalf("e.LastError() = %v on second read, want nil", got)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// connState is the state of a connEndpoint, as seen by State(). This file
+// only deals with the handful of states the Fast Open and Happy Eyeballs v2
+// connect paths need to reason about; the full passive/active-open state
+// machine (FinWait1/2, Closing, TimeWait, ...) lives alongside connection
+// teardown elsewhere in the package and is out of scope for connEndpoint.
+type connState int
+
+const (
+	csInitial connState = iota
+	csConnecting
+	csEstablished
+	csListen
+	csError
+)
+
+// segmentSink is the minimal surface connEndpoint needs in order to hand a
+// constructed segment to the network layer. The production implementation
+// is backed by a *stack.Route; tests substitute a fake that records what
+// was sent and lets the test inject a reply.
+type segmentSink interface {
+	sendTCP(flags header.TCPFlags, opts []byte, data []byte) tcpip.Error
+}
+
+// connEndpoint is a TCP transport protocol endpoint. Only the fields the
+// Fast Open and Happy Eyeballs v2 connect paths touch are modeled here;
+// it is deliberately named and scoped apart from the package's full
+// endpoint implementation (which this tree doesn't carry), rather than
+// reusing the name, since it has none of that type's congestion control,
+// retransmission timers, or segment queues.
+type connEndpoint struct {
+	mu    sync.Mutex
+	proto *connProtocol
+	wq    *waiter.Queue
+
+	localAddr  tcpip.FullAddress
+	remoteAddr tcpip.FullAddress
+	state      connState
+	lastError  tcpip.Error
+	route      segmentSink
+
+	establishedCh chan struct{}
+
+	// rcvQueue holds data delivered to the endpoint before the
+	// application has read it, including any Fast Open payload received
+	// on the SYN before the handshake completed.
+	rcvQueue [][]byte
+
+	fastOpen fastOpenEndpointState
+
+	// fastOpenQueueLen is the value set via SetSockOptInt(TCPFastOpenOption, n):
+	// the maximum number of Fast-Open-completed connections this
+	// listener will hold in its accept queue ahead of the client's
+	// final ACK, mirroring Linux's TCP_FASTOPEN qlen. Zero means Fast
+	// Open is disabled for this listener.
+	fastOpenQueueLen int
+
+	listener *connListener
+
+	// dialRoute resolves the segmentSink to write a SYN through for
+	// addr. The production implementation looks this up via the
+	// stack's route table; tests substitute a fake. It is consulted by
+	// connectLocked only when route hasn't already been set directly
+	// (as the tests in tcp_fastopen_test.go that assign e.route do).
+	dialRoute func(addr tcpip.FullAddress, candidate *connEndpoint) (segmentSink, tcpip.Error)
+}
+
+func newConnEndpoint(proto *connProtocol, wq *waiter.Queue) *connEndpoint {
+	return &connEndpoint{
+		proto:         proto,
+		wq:            wq,
+		establishedCh: make(chan struct{}),
+	}
+}
+
+// established is closed once the endpoint reaches csEstablished.
+func (e *connEndpoint) established() <-chan struct{} {
+	return e.establishedCh
+}
+
+// State returns the endpoint's current state.
+func (e *connEndpoint) State() connState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state
+}
+
+// SetSockOptBool implements the subset of tcpip.Endpoint's SetSockOptBool
+// relevant to Fast Open; the rest of the socket options continue to be
+// handled by the switch in the endpoint's main SetSockOptBool.
+func (e *connEndpoint) SetSockOptBool(opt tcpip.SockOptBool, v bool) tcpip.Error {
+	switch opt {
+	case tcpip.TCPFastOpenConnectOption:
+		e.mu.Lock()
+		e.fastOpen.connect = v
+		e.mu.Unlock()
+		return nil
+	default:
+		return &tcpip.ErrUnknownProtocolOption{}
+	}
+}
+
+// GetSockOptBool is the read-side counterpart of SetSockOptBool above.
+func (e *connEndpoint) GetSockOptBool(opt tcpip.SockOptBool) (bool, tcpip.Error) {
+	switch opt {
+	case tcpip.TCPFastOpenConnectOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.fastOpen.connect, nil
+	default:
+		return false, &tcpip.ErrUnknownProtocolOption{}
+	}
+}
+
+// SetSockOptInt implements the subset of tcpip.Endpoint's SetSockOptInt
+// relevant to Fast Open: TCPFastOpenOption enables (value > 0) or disables
+// (value == 0) accepting Fast Open SYNs on a listening endpoint, with
+// value bounding how many Fast-Open-completed connections may sit in the
+// accept queue ahead of the client's final ACK, mirroring Linux's
+// TCP_FASTOPEN qlen semantics.
+func (e *connEndpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
+	switch opt {
+	case tcpip.TCPFastOpenOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if v < 0 {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		e.fastOpenQueueLen = v
+		return nil
+	default:
+		return &tcpip.ErrUnknownProtocolOption{}
+	}
+}
+
+// GetSockOptInt is the read-side counterpart of SetSockOptInt above.
+func (e *connEndpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
+	switch opt {
+	case tcpip.TCPFastOpenOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.fastOpenQueueLen, nil
+	default:
+		return 0, &tcpip.ErrUnknownProtocolOption{}
+	}
+}
+
+// Write queues p for transmission. Before the connection is established,
+// this is how a caller stages the payload Connect will piggyback on the
+// Fast Open SYN, mirroring the way Linux's TCP_FASTOPEN_CONNECT lets
+// write(2) precede connect(2).
+func (e *connEndpoint) Write(p []byte) (int, tcpip.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch e.state {
+	case csInitial, csConnecting:
+		e.fastOpen.pending = append(e.fastOpen.pending, p...)
+		return len(p), nil
+	case csEstablished:
+		return len(p), e.route.sendTCP(header.TCPFlagAck, nil, p)
+	default:
+		return 0, &tcpip.ErrClosedForSend{}
+	}
+}
+
+// Connect implements the active, Fast-Open-aware open: if
+// TCPFastOpenConnectOption is set and a cookie is cached for addr, the
+// data queued by a pre-Connect Write rides the SYN; otherwise the SYN
+// either probes for a cookie (if Fast Open is requested but no cookie is
+// cached yet) or is a plain SYN.
+func (e *connEndpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
+	if err := e.connectLocked(addr); err != nil {
+		return err
+	}
+	return &tcpip.ErrConnectStarted{}
+}
+
+// connectLocked performs the actual handshake-initiating work shared by
+// Connect and ConnectMulti's per-address dial; unlike Connect, it reports
+// failure to start (not ErrConnectStarted) so ConnectMulti can distinguish
+// "failed to even send a SYN" from "still racing".
+func (e *connEndpoint) connectLocked(addr tcpip.FullAddress) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != csInitial {
+		return &tcpip.ErrAlreadyConnecting{}
+	}
+	if e.route == nil {
+		if e.dialRoute == nil {
+			return &tcpip.ErrNoRoute{}
+		}
+		route, err := e.dialRoute(addr, e)
+		if err != nil {
+			return err
+		}
+		e.route = route
+	}
+	e.remoteAddr = addr
+	e.state = csConnecting
+
+	var optBuf [40]byte
+	opts, data := e.fastOpen.synOptions(e.proto, addr.Addr, optBuf[:])
+
+	if err := e.route.sendTCP(header.TCPFlagSyn, opts, data); err != nil {
+		e.state = csError
+		e.lastError = err
+		if e.fastOpen.connect {
+			e.proto.stats.FastOpen.TFOActiveFail.Increment()
+		}
+		return err
+	}
+	return nil
+}
+
+// handleSynAck is invoked by the segment-dispatch loop (elsewhere in the
+// package) when the SYN-ACK for this connection's handshake arrives. If
+// the endpoint was already cancelled (it lost a Happy Eyeballs race
+// before this SYN-ACK arrived), the peer is told with a RST instead of
+// being allowed to complete a connection this endpoint will never be
+// handed to; otherwise it finalizes Fast Open bookkeeping and transitions
+// the endpoint to csEstablished.
+func (e *connEndpoint) handleSynAck(opts []byte, dataAcked bool) {
+	e.mu.Lock()
+	if e.state == csError {
+		e.route.sendTCP(header.TCPFlagRst|header.TCPFlagAck, nil, nil)
+		e.mu.Unlock()
+		return
+	}
+	e.fastOpen.handleSynAck(e.proto, e.remoteAddr.Addr, opts, dataAcked)
+	e.state = csEstablished
+	// Send the queued data the SYN did not deliver: all of it after a
+	// cookie request or an unacknowledged SYN, otherwise whatever lay
+	// past the fastOpenMaxSynData bytes the SYN carried.
+	unsent := e.fastOpen.pending
+	if e.fastOpen.cookie != nil && dataAcked {
+		if len(unsent) > fastOpenMaxSynData {
+			unsent = unsent[fastOpenMaxSynData:]
+		} else {
+			unsent = nil
+		}
+	}
+	e.fastOpen.pending = nil
+	if len(unsent) > 0 {
+		e.route.sendTCP(header.TCPFlagAck, nil, unsent)
+	}
+	e.mu.Unlock()
+	close(e.establishedCh)
+}
+
+// resetAndClose cancels a connection attempt that lost a Happy Eyeballs
+// race. It doesn't need to send anything itself: the attempt's
+// transportEndpointID is simply abandoned, and marking the state here is
+// what makes a SYN-ACK that arrives later (see handleSynAck) answered
+// with a RST instead of completing the connection.
+func (e *connEndpoint) resetAndClose() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = csError
+}
+
+// LastError returns the error of the last failed connection attempt. For
+// an endpoint created by ConnectMulti, this is only set if every address
+// failed; a losing-but-not-failing attempt never populates it.
+func (e *connEndpoint) LastError() tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.lastError
+	e.lastError = nil
+	return err
+}
+
+// GetRemoteAddress returns the address this endpoint is connected to; for
+// ConnectMulti, this is the address that won the race. It returns
+// ErrNotConnected until the endpoint reaches csEstablished.
+func (e *connEndpoint) GetRemoteAddress() (tcpip.FullAddress, tcpip.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != csEstablished {
+		return tcpip.FullAddress{}, &tcpip.ErrNotConnected{}
+	}
+	return e.remoteAddr, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// connListener holds the accept queue for a passive (listening)
+// connEndpoint. The rest of Listen's bookkeeping (backlog limits unrelated
+// to Fast Open, SYN-flood defenses, ...) lives alongside the rest of the
+// passive-open path elsewhere in the package.
+type connListener struct {
+	mu               sync.Mutex
+	proto            *connProtocol
+	wq               *waiter.Queue
+	local            tcpip.FullAddress
+	backlog          int
+	fastOpenQueueLen int
+	acceptQueue      []*connEndpoint
+}
+
+// Listen marks e as passive, ready for handleSYN below to deliver
+// connections to. Fast Open SYNs are only accepted if
+// SetSockOptInt(TCPFastOpenOption, ...) has set a non-zero queue length.
+func (e *connEndpoint) Listen(backlog int) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != csInitial {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+	e.state = csListen
+	e.listener = &connListener{
+		proto:            e.proto,
+		wq:               e.wq,
+		local:            e.localAddr,
+		backlog:          backlog,
+		fastOpenQueueLen: e.fastOpenQueueLen,
+	}
+	return nil
+}
+
+// Accept pops the next connection off l's accept queue. A connection
+// whose SYN carried a valid Fast Open cookie is already in csEstablished
+// with any SYN-borne payload queued for Read by the time it appears here,
+// having skipped the rest of the three-way handshake entirely.
+func (l *connListener) Accept() (*connEndpoint, tcpip.Error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.acceptQueue) == 0 {
+		return nil, &tcpip.ErrWouldBlock{}
+	}
+	ep := l.acceptQueue[0]
+	l.acceptQueue = l.acceptQueue[1:]
+	return ep, nil
+}
+
+// handleSYN processes an inbound SYN against a listening endpoint.
+//
+//   - No Fast Open option at all: returns (nil, nil), telling the caller
+//     to fall back to the normal three-way handshake.
+//   - An empty-cookie request: a fresh cookie is generated and returned so
+//     the caller's SYN-ACK can carry it, and the caller again falls back
+//     to a normal handshake (the client isn't allowed to send data yet).
+//   - A valid cookie: the new endpoint is created and handed to the
+//     accept queue immediately, with payload already queued for Read,
+//     before the client's final ACK has even been sent.
+//   - An invalid cookie: treated the same as no cookie, per RFC 7413
+//     §4.1.2's guidance to fail open onto a regular handshake rather than
+//     refuse the connection.
+func (l *connListener) handleSYN(remote tcpip.FullAddress, opts []byte, payload []byte, route segmentSink) (accepted *connEndpoint, cookieToSend *[tfoCookieLen]byte, err tcpip.Error) {
+	if l.fastOpenQueueLen <= 0 {
+		return nil, nil, nil
+	}
+	l.proto.maybeRotateFastOpen()
+
+	cookie, hasOption := parseFastOpenOption(opts)
+	if !hasOption {
+		return nil, nil, nil
+	}
+
+	if len(cookie) == 0 {
+		l.proto.stats.FastOpen.TFOCookieReqs.Increment()
+		c, genErr := l.proto.fastOpen.generate(remote.Addr)
+		if genErr != nil {
+			return nil, nil, &tcpip.ErrConnectionAborted{}
+		}
+		l.proto.stats.FastOpen.TFOCookieSent.Increment()
+		return nil, &c, nil
+	}
+
+	var fixed [tfoCookieLen]byte
+	if len(cookie) != tfoCookieLen {
+		l.proto.stats.FastOpen.TFOPassiveFail.Increment()
+		return nil, nil, nil
+	}
+	copy(fixed[:], cookie)
+	if !l.proto.fastOpen.valid(remote.Addr, fixed) {
+		l.proto.stats.FastOpen.TFOPassiveFail.Increment()
+		return nil, nil, nil
+	}
+
+	ep := newConnEndpoint(l.proto, l.wq)
+	ep.localAddr = l.local
+	ep.remoteAddr = remote
+	ep.route = route
+	ep.state = csEstablished
+	if len(payload) > 0 {
+		ep.rcvQueue = append(ep.rcvQueue, append([]byte(nil), payload...))
+	}
+
+	l.mu.Lock()
+	if len(l.acceptQueue) >= l.fastOpenQueueLen {
+		l.mu.Unlock()
+		l.proto.stats.FastOpen.TFOPassiveFail.Increment()
+		return nil, nil, nil
+	}
+	l.acceptQueue = append(l.acceptQueue, ep)
+	l.mu.Unlock()
+	l.wq.Notify(waiter.ReadableEvents)
+
+	return ep, nil, nil
+}
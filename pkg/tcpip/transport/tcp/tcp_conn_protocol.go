@@ -0,0 +1,67 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import "time"
+
+// Stats holds the TCP-protocol-wide counters this package contributes to
+// tcpip.TransportProtocolStats.TCP, alongside the congestion-control and
+// retransmission counters tracked elsewhere in the package.
+type Stats struct {
+	// FastOpen holds the TCP_FASTOPEN counters, see tcp_fastopen.go.
+	FastOpen FastOpenStats
+	// HappyEyeballs holds the RFC 8305 race counters, see
+	// happy_eyeballs.go.
+	HappyEyeballs happyEyeballsStats
+}
+
+// connProtocol tracks the state the Fast Open and Happy Eyeballs v2 connect
+// paths need to share across every connEndpoint: the Fast Open cookie key
+// and client cache, and the aggregate stats counters. One connProtocol
+// exists per stack. It is named and scoped apart from the package's full
+// protocol implementation (which this tree doesn't carry, and which also
+// owns demultiplexing, the timer wheel, and the rest of the protocol-wide
+// state) rather than reusing that name.
+type connProtocol struct {
+	// fastOpen generates and validates the cookies this stack offers as
+	// a Fast Open listener.
+	fastOpen *serverFastOpenState
+	// clientFastOpen caches cookies this stack has been issued by peers
+	// it has connected out to.
+	clientFastOpen *clientFastOpenCache
+
+	stats Stats
+}
+
+// NewConnProtocol creates the per-stack state backing the Fast Open and
+// Happy Eyeballs v2 connect paths.
+func NewConnProtocol() *connProtocol {
+	return &connProtocol{
+		fastOpen:       newServerFastOpenState(),
+		clientFastOpen: newClientFastOpenCache(),
+		stats: Stats{
+			FastOpen:      newFastOpenStats(),
+			HappyEyeballs: newHappyEyeballsStats(),
+		},
+	}
+}
+
+// maybeRotateFastOpen rotates the server-side cookie key if it is due; it
+// is called on the SYN-processing path rather than from a background
+// timer so a stack that never accepts a Fast Open SYN never spends a
+// goroutine on it.
+func (p *connProtocol) maybeRotateFastOpen() {
+	p.fastOpen.maybeRotate(time.Now())
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+const (
+	// tfoCookieLen is the length in bytes of a Fast Open cookie, per
+	// RFC 7413 section 4.1.
+	tfoCookieLen = 8
+
+	// tfoCookieKeyRotationInterval is how often the server-side cookie
+	// signing key is rotated. Cookies generated under the previous key
+	// remain valid for one additional rotation so that in-flight SYNs
+	// are not rejected by a rotation that races with the handshake.
+	tfoCookieKeyRotationInterval = 10 * time.Minute
+
+	// tfoMaxPendingCookies bounds the client-side cookie cache so a host
+	// that connects out to many distinct peers cannot grow it without
+	// bound.
+	tfoMaxPendingCookies = 1 << 10
+)
+
+// fastOpenCookieKey is an AES-128 key used by a listening stack to mint and
+// verify Fast Open cookies without retaining any per-connection state.
+type fastOpenCookieKey [16]byte
+
+// serverFastOpenState holds the per-stack state required to generate and
+// validate TCP Fast Open cookies offered to connecting clients. It is
+// rotated periodically so that a key compromise only exposes a bounded
+// window of cookies.
+type serverFastOpenState struct {
+	mu sync.Mutex
+
+	// current is used to sign new cookies and validate incoming ones.
+	current fastOpenCookieKey
+	// previous validates cookies signed just before the last rotation,
+	// so a cookie handed out right before a rotation is not rejected.
+	previous fastOpenCookieKey
+	hasPrev  bool
+
+	rotatedAt time.Time
+}
+
+func newServerFastOpenState() *serverFastOpenState {
+	s := &serverFastOpenState{}
+	s.rotateLocked(time.Now())
+	return s
+}
+
+func (s *serverFastOpenState) rotateLocked(now time.Time) {
+	s.previous = s.current
+	s.hasPrev = s.rotatedAt != time.Time{}
+	if _, err := rand.Read(s.current[:]); err != nil {
+		// crypto/rand.Read only fails if the system entropy source is
+		// broken, which leaves nothing sane to do; panic rather than
+		// silently hand out a predictable cookie key.
+		panic("tcp: failed to generate Fast Open cookie key: " + err.Error())
+	}
+	s.rotatedAt = now
+}
+
+// maybeRotate rotates the cookie key if the rotation interval has elapsed.
+func (s *serverFastOpenState) maybeRotate(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.rotatedAt) >= tfoCookieKeyRotationInterval {
+		s.rotateLocked(now)
+	}
+}
+
+// cookieFor computes the Fast Open cookie for clientAddr under the given
+// key: AES-128(key, clientAddr) truncated to tfoCookieLen bytes, per the
+// scheme described in RFC 7413 appendix A.
+func cookieFor(key fastOpenCookieKey, clientAddr tcpip.Address) ([tfoCookieLen]byte, error) {
+	var cookie [tfoCookieLen]byte
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return cookie, err
+	}
+	var plaintext [aes.BlockSize]byte
+	copy(plaintext[:], clientAddr.AsSlice())
+	var ciphertext [aes.BlockSize]byte
+	block.Encrypt(ciphertext[:], plaintext[:])
+	copy(cookie[:], ciphertext[:tfoCookieLen])
+	return cookie, nil
+}
+
+// generate mints the cookie the server should offer to clientAddr in a
+// SYN-ACK, signed with the current key.
+func (s *serverFastOpenState) generate(clientAddr tcpip.Address) ([tfoCookieLen]byte, error) {
+	s.mu.Lock()
+	key := s.current
+	s.mu.Unlock()
+	return cookieFor(key, clientAddr)
+}
+
+// valid reports whether cookie is a valid Fast Open cookie for clientAddr
+// under either the current or the immediately preceding key.
+func (s *serverFastOpenState) valid(clientAddr tcpip.Address, cookie [tfoCookieLen]byte) bool {
+	s.mu.Lock()
+	cur, prev, hasPrev := s.current, s.previous, s.hasPrev
+	s.mu.Unlock()
+
+	if want, err := cookieFor(cur, clientAddr); err == nil && want == cookie {
+		return true
+	}
+	if hasPrev {
+		if want, err := cookieFor(prev, clientAddr); err == nil && want == cookie {
+			return true
+		}
+	}
+	return false
+}
+
+// clientFastOpenCache is a small, bounded, LRU cache of cookies the client
+// has previously been issued by remote peers, keyed by remote address. It
+// lets a subsequent Connect to the same peer send data on the SYN instead of
+// the empty-cookie probe required the first time.
+type clientFastOpenCache struct {
+	mu      sync.Mutex
+	entries map[tcpip.Address]*tfoCacheEntry
+	order   []tcpip.Address // front is least-recently-used
+}
+
+type tfoCacheEntry struct {
+	cookie [tfoCookieLen]byte
+	valid  bool // false once the peer has rejected the option outright
+}
+
+func newClientFastOpenCache() *clientFastOpenCache {
+	return &clientFastOpenCache{entries: make(map[tcpip.Address]*tfoCacheEntry)}
+}
+
+// cookie returns the cached cookie for addr, if any.
+func (c *clientFastOpenCache) cookie(addr tcpip.Address) ([tfoCookieLen]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[addr]
+	if ok {
+		c.touchLocked(addr)
+	}
+	if !ok || !e.valid {
+		return [tfoCookieLen]byte{}, false
+	}
+	return e.cookie, true
+}
+
+// touchLocked moves addr to the most-recently-used end of c.order. c.mu
+// must be held.
+func (c *clientFastOpenCache) touchLocked(addr tcpip.Address) {
+	for i, a := range c.order {
+		if a == addr {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, addr)
+}
+
+// update records the cookie the server returned for addr, evicting the
+// least-recently-used entry if the cache is full.
+func (c *clientFastOpenCache) update(addr tcpip.Address, cookie [tfoCookieLen]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[addr]; !ok {
+		if len(c.entries) >= tfoMaxPendingCookies {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.entries, oldest)
+		}
+	}
+	c.touchLocked(addr)
+	c.entries[addr] = &tfoCacheEntry{cookie: cookie, valid: true}
+}
+
+// invalidate marks addr's cookie as unusable, forcing the next Connect to
+// fall back to an empty-cookie probe. Used when the server answers a
+// cookied SYN with a plain SYN-ACK, indicating it no longer recognizes the
+// cookie.
+func (c *clientFastOpenCache) invalidate(addr tcpip.Address) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[addr]; ok {
+		e.valid = false
+	}
+}
+
+// FastOpenStats holds the TFO counters exposed through
+// tcpip.TransportProtocolStats.TCP. They are plain *tcpip.StatCounter so
+// they compose with the rest of the stats struct's atomic-increment
+// convention.
+type FastOpenStats struct {
+	// TFOCookieReqs counts the number of empty-cookie probes a passive
+	// endpoint has received.
+	TFOCookieReqs *tcpip.StatCounter
+	// TFOCookieSent counts the number of cookies a passive endpoint has
+	// handed out in a SYN-ACK.
+	TFOCookieSent *tcpip.StatCounter
+	// TFOPassiveFail counts failed passive (server-side) Fast Open
+	// attempts, e.g. an invalid cookie.
+	TFOPassiveFail *tcpip.StatCounter
+	// TFOActiveFail counts failed active (client-side) Fast Open
+	// attempts, e.g. the peer not acknowledging the option.
+	TFOActiveFail *tcpip.StatCounter
+}
+
+func newFastOpenStats() FastOpenStats {
+	return FastOpenStats{
+		TFOCookieReqs:  &tcpip.StatCounter{},
+		TFOCookieSent:  &tcpip.StatCounter{},
+		TFOPassiveFail: &tcpip.StatCounter{},
+		TFOActiveFail:  &tcpip.StatCounter{},
+	}
+}
+
+const (
+	// fastOpenOptionKind is the TCP option kind assigned to Fast Open by
+	// RFC 7413 section 4.
+	fastOpenOptionKind = 34
+
+	// fastOpenMaxSynData is the largest payload this implementation will
+	// piggyback on a Fast Open SYN. The RFC ties the real limit to the
+	// path MSS; capping it here keeps the SYN itself from ever needing
+	// fragmentation regardless of the negotiated MSS.
+	fastOpenMaxSynData = 1380
+)
+
+// encodeFastOpenOption writes a Fast Open option carrying cookie (empty
+// for a cookie request) at the start of b, following the same
+// write-into-the-caller's-option-buffer convention the rest of the SYN's
+// options (MSS, window scale, SACK-permitted) are built with. It returns
+// the number of bytes written.
+func encodeFastOpenOption(cookie []byte, b []byte) int {
+	n := 2 + len(cookie)
+	b[0] = fastOpenOptionKind
+	b[1] = byte(n)
+	copy(b[2:], cookie)
+	return n
+}
+
+// parseFastOpenOption scans a segment's TCP options for a Fast Open
+// option. ok is false if no such option is present; if ok is true, cookie
+// is nil for a bare cookie request and non-nil otherwise.
+func parseFastOpenOption(opts []byte) (cookie []byte, ok bool) {
+	for i := 0; i < len(opts); {
+		switch kind := opts[i]; kind {
+		case 0: // End of option list.
+			return nil, false
+		case 1: // NOP, padding between options.
+			i++
+		default:
+			if i+1 >= len(opts) {
+				return nil, false
+			}
+			l := int(opts[i+1])
+			if l < 2 || i+l > len(opts) {
+				return nil, false
+			}
+			if kind == fastOpenOptionKind {
+				return append([]byte(nil), opts[i+2:i+l]...), true
+			}
+			i += l
+		}
+	}
+	return nil, false
+}
+
+// fastOpenEndpointState is the per-endpoint Fast Open state, embedded in
+// connEndpoint. It is deliberately small: the cookie cache and the cookie
+// signing key it draws on live at the protocol (stack-wide) level, see
+// tcp_conn_protocol.go.
+type fastOpenEndpointState struct {
+	// connect mirrors the TCPFastOpenConnectOption SockOpt: when true,
+	// Connect is allowed to send data queued by a pre-Connect Write on
+	// the SYN itself, the way Linux's TCP_FASTOPEN_CONNECT does.
+	connect bool
+
+	// cookie is the cookie offered on the in-flight SYN, nil if this
+	// attempt is a bare cookie request or Fast Open isn't in use.
+	cookie *[tfoCookieLen]byte
+
+	// pending holds data queued by Write before Connect completes, and
+	// (on the client) the data sent on the SYN until it is ACKed.
+	pending []byte
+}
+
+// synOptions builds the option bytes and the (possibly truncated) payload
+// Connect should put on the SYN, consulting the protocol's client cookie
+// cache for addr. The returned data is the slice of fs.pending actually
+// carried by this SYN; the caller is responsible for retaining the rest
+// for transmission once the connection reaches ESTABLISHED.
+func (fs *fastOpenEndpointState) synOptions(p *connProtocol, addr tcpip.Address, optBuf []byte) (opts []byte, data []byte) {
+	if !fs.connect {
+		return nil, nil
+	}
+
+	if cookie, ok := p.clientFastOpen.cookie(addr); ok {
+		fs.cookie = &cookie
+		n := encodeFastOpenOption(cookie[:], optBuf)
+		data = fs.pending
+		if len(data) > fastOpenMaxSynData {
+			data = data[:fastOpenMaxSynData]
+		}
+		return optBuf[:n], data
+	}
+
+	// No cookie cached yet: probe with an empty option. RFC 7413 §4.1.2
+	// forbids sending data alongside a bare cookie request, so the
+	// pending write waits for the handshake to finish normally.
+	fs.cookie = nil
+	n := encodeFastOpenOption(nil, optBuf)
+	return optBuf[:n], nil
+}
+
+// handleSynAck updates Fast Open state once the SYN-ACK for this
+// connection attempt arrives. If the peer's SYN-ACK carried a Fast Open
+// option, any fresh cookie it offers is cached for next time; if it
+// carried no option at all despite the SYN having requested one, the
+// in-flight data (if any) was not acknowledged and must be resent after
+// the handshake completes normally.
+func (fs *fastOpenEndpointState) handleSynAck(p *connProtocol, addr tcpip.Address, opts []byte, dataAcked bool) {
+	cookie, ok := parseFastOpenOption(opts)
+	switch {
+	case ok && len(cookie) == tfoCookieLen:
+		var fixed [tfoCookieLen]byte
+		copy(fixed[:], cookie)
+		p.clientFastOpen.update(addr, fixed)
+	case fs.cookie != nil && !ok:
+		// The server didn't echo the option at all: it has forgotten
+		// (or never validated) the cookie we sent. Stop offering it.
+		p.clientFastOpen.invalidate(addr)
+		p.stats.FastOpen.TFOActiveFail.Increment()
+	}
+	if fs.cookie != nil && ok && !dataAcked {
+		p.stats.FastOpen.TFOActiveFail.Increment()
+	}
+}